@@ -10,8 +10,11 @@ import (
 	"io"
 	"log"
 	"net"
+	"strconv"
+	"time"
 
 	"github.com/nictuku/dht"
+	"github.com/nictuku/wherez/nat"
 )
 
 var (
@@ -23,10 +26,7 @@ var (
 	allowSelfConnection = false
 )
 
-const (
-	messageLen = 20
-	dedupeLen  = 10
-)
+const dedupeLen = 10
 
 func init() {
 	var err error
@@ -37,13 +37,13 @@ func init() {
 	dedupe = dedupe[0:dedupeLen]
 }
 
-func obtainPeers(d *dht.DHT, passphrase []byte, c chan Peer) {
+func obtainPeers(d *dht.DHT, passphrase []byte, c chan Peer, db *PeerDB) {
 	for r := range d.PeersRequestResults {
 		for _, peers := range r {
 			for _, x := range peers {
 				// A DHT peer for our infohash was found. It
 				// needs to be authenticated.
-				checkPeer(dht.DecodePeerAddress(x), passphrase, c)
+				checkPeer(dht.DecodePeerAddress(x), passphrase, c, db)
 			}
 		}
 	}
@@ -89,11 +89,44 @@ func newChallenge() (m Challenge, err error) {
 	return
 }
 
-func checkPeer(addr string, passphrase []byte, c chan Peer) {
-	if peer, err := verifyPeer(addr, passphrase); err == nil {
-		c <- peer
+// ioTimeout bounds how long either side of the handshake/auth exchange waits
+// for the other before giving up. It's lifted once authentication succeeds,
+// since a served Node (see protocol.go) holds the connection open
+// indefinitely.
+const ioTimeout = 30 * time.Second
+
+// setDeadline applies t if conn exposes SetDeadline. conn is typed as
+// io.ReadWriteCloser everywhere in this file so handleConn can keep being
+// exercised with plain buffers in tests; those don't have deadlines, and
+// that's fine.
+func setDeadline(conn io.ReadWriteCloser, t time.Time) {
+	if dc, ok := conn.(interface{ SetDeadline(time.Time) error }); ok {
+		dc.SetDeadline(t)
 	}
+}
 
+func checkPeer(addr string, passphrase []byte, c chan Peer, db *PeerDB) {
+	peer, err := verifyPeer(addr, passphrase)
+	if err != nil {
+		if db != nil {
+			if err == errSelfConnect {
+				// Not a real peer, just us. Don't let it keep coming back
+				// as a "known" candidate on the next cold start.
+				db.Forget(addr)
+			} else {
+				db.recordFailure(addr)
+			}
+		}
+		return
+	}
+	if db != nil {
+		if _, portStr, err := net.SplitHostPort(peer.Addr); err == nil {
+			if port, err := strconv.Atoi(portStr); err == nil {
+				db.recordSuccess(addr, uint16(port))
+			}
+		}
+	}
+	c <- peer
 }
 
 // verifyPeer connects to a host:port address specified in peer and sends it a
@@ -106,31 +139,55 @@ func verifyPeer(peer string, passphrase []byte) (p Peer, err error) {
 	if err != nil {
 		return
 	}
-	defer conn.Close()
+	setDeadline(conn, time.Now().Add(ioTimeout))
+	// handshake takes over framing from here; on any failure below we close
+	// conn ourselves since we haven't handed it off to the caller yet.
+	sec, err := handshake(conn, passphrase)
+	if err != nil {
+		conn.Close()
+		return
+	}
 	var challenge Challenge
 	challenge, err = newChallenge()
 	if err != nil {
 		// log.Printf("auth newChallenge error %v", err)
+		sec.Close()
 		return
 	}
-	if err = binary.Write(conn, binary.LittleEndian, challenge); err != nil {
+	if err = binary.Write(sec, binary.LittleEndian, challenge); err != nil {
 		// The other side is either unreachable or we connected to
 		// ourselves and closed the connection.
+		sec.Close()
 		return
 	}
-	in := new(Response)
-	if err = binary.Read(conn, binary.LittleEndian, in); err != nil {
+	typ, payload, err := readFrame(sec)
+	if err != nil {
 		// log.Println("auth could not read response from conn:", err)
+		sec.Close()
+		return
+	}
+	if typ == frameTypeSelfConnect {
+		sec.Close()
+		return p, errSelfConnect
+	}
+	in, err := decodeResponse(payload)
+	if err != nil {
+		sec.Close()
 		return
 	}
 	if !checkMAC(challenge.Challenge[:], in.MAC[:], passphrase) {
+		sec.Close()
 		return p, fmt.Errorf("Invalid challenge response")
 	}
 	host, _, err := net.SplitHostPort(peer)
 	if err != nil {
+		sec.Close()
 		return
 	}
-	return Peer{Addr: fmt.Sprintf("%v:%v", host, in.Port)}, nil
+	// Authenticated: this conn is no longer ours to time out. Whoever claims
+	// Peer.Conn next owns its deadlines.
+	setDeadline(conn, time.Time{})
+	return Peer{Addr: fmt.Sprintf("%v:%v", host, in.Port), Conn: sec}, nil
 }
 
 func randMsg() ([]byte, error) {
@@ -139,10 +196,23 @@ func randMsg() ([]byte, error) {
 	return b, err
 }
 
-func listenAuth(port, appPort int, passphrase []byte) (net.Addr, error) {
+// listenAuth starts accepting and authenticating connections on port, and
+// returns the channel a caller should close to have the port mapping (if
+// natm is set) cleanly removed from the NAT device.
+func listenAuth(port, appPort int, passphrase []byte, natm nat.Interface, node *Node) (net.Addr, chan struct{}, error) {
 	ln, err := net.ListenTCP("tcp", &net.TCPAddr{Port: port})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	stopNAT := make(chan struct{})
+	if natm != nil {
+		lnPort := ln.Addr().(*net.TCPAddr).Port
+		go nat.Map(natm, stopNAT, "tcp", lnPort, lnPort, "wherez")
+		if ip, err := natm.ExternalIP(); err == nil {
+			log.Printf("listenAuth: external address is %v:%v", ip, lnPort)
+		} else {
+			log.Println("listenAuth: could not determine external IP:", err)
+		}
 	}
 	go func() {
 		for {
@@ -151,10 +221,10 @@ func listenAuth(port, appPort int, passphrase []byte) (net.Addr, error) {
 				log.Println("listenAuth accept error. Stopping listener.", err)
 				return
 			}
-			go handleConn(conn, appPort, passphrase)
+			go handleConn(conn, appPort, passphrase, node)
 		}
 	}()
-	return ln.Addr(), nil
+	return ln.Addr(), stopNAT, nil
 }
 
 // Response containing proof that the server (Bob) knows the shared secret and
@@ -165,14 +235,22 @@ type Response struct {
 	MAC [32]byte
 }
 
-func handleConn(conn io.ReadWriteCloser, appPort int, passphrase []byte) {
-	// Everything is done with one packet in and one packet out, so close
-	// the connection after this function ends.
+func handleConn(conn io.ReadWriteCloser, appPort int, passphrase []byte, node *Node) {
+	// Unless node is set, everything is done with the handshake followed by
+	// one challenge in and one response out, so close the connection after
+	// this function ends. With a node, it's closed once node's session ends.
 	defer conn.Close()
 
+	setDeadline(conn, time.Now().Add(ioTimeout))
+
+	sec, err := handshake(conn, passphrase)
+	if err != nil {
+		return
+	}
+
 	// Parse the incoming packet.
 	in := new(Challenge)
-	err := binary.Read(conn, binary.LittleEndian, in)
+	err = binary.Read(sec, binary.LittleEndian, in)
 	if err != nil {
 		return
 	}
@@ -189,12 +267,10 @@ func handleConn(conn io.ReadWriteCloser, appPort int, passphrase []byte) {
 	// dedupe is a small byte array generated on initialization that
 	// identifies this server. If the incoming request has the same dedupe ID,
 	// it means it's trying to connect to itself. That's a normal thing, but
-	// obviously useless, so close the connection.
-	// To blacklist the address on the client side, the protocol would have
-	// to have another step for the error feedback and for now that doesn't
-	// seem worth it.
+	// obviously useless, so tell the client with a frameTypeSelfConnect
+	// message and close the connection.
 	if !allowSelfConnection && bytes.Equal(in.Dedupe[:], dedupe) {
-		// Connection to self. Closing.
+		writeFrame(sec, frameTypeSelfConnect, nil)
 		return
 	}
 	// Calculate the challenge response.
@@ -205,10 +281,24 @@ func handleConn(conn io.ReadWriteCloser, appPort int, passphrase []byte) {
 	response := Response{Port: uint16(appPort)}
 	copy(response.MAC[:], mac.Sum(nil))
 
-	if err = binary.Write(conn, binary.LittleEndian, response); err != nil {
+	if err = writeFrame(sec, frameTypeResponse, encodeResponse(response)); err != nil {
 		// log.Println("handleConn failed to write to remote peer:", err)
 		return
 	}
+
+	if node == nil {
+		return
+	}
+	// Authenticated and about to be handed to a long-lived Session: this
+	// conn is no longer handleConn's to time out.
+	setDeadline(conn, time.Time{})
+	peer := Peer{Conn: sec}
+	if nc, ok := conn.(net.Conn); ok {
+		peer.Addr = nc.RemoteAddr().String()
+	}
+	if err := node.Serve(peer); err != nil {
+		log.Println("wherez: session ended:", err)
+	}
 }
 
 func checkMAC(message, messageMAC, key []byte) bool {
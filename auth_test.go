@@ -2,8 +2,10 @@ package wherez
 
 import (
 	"bytes"
+	"math/rand"
 	"net"
 	"testing"
+	"time"
 )
 
 type rwc struct {
@@ -28,7 +30,7 @@ func TestAuth(t *testing.T) {
 	want := "localhost:3000"
 
 	// Starts server in the background.
-	addr, err := listenAuth(0, 3000, passphrase)
+	addr, _, err := listenAuth(0, 3000, passphrase, nil, nil)
 	if err != nil {
 		t.Fatalf("listenAuth error %v", err)
 	}
@@ -50,7 +52,7 @@ func TestBrokenAuth(t *testing.T) {
 	passphrase := []byte("secrettwo")
 
 	// Starts server in the background.
-	addr, err := listenAuth(0, 3000, passphrase)
+	addr, _, err := listenAuth(0, 3000, passphrase, nil, nil)
 	if err != nil {
 		t.Fatalf("listenAuth error %v", err)
 	}
@@ -61,3 +63,29 @@ func TestBrokenAuth(t *testing.T) {
 	}
 	allowSelfConnection = false
 }
+
+// TestHandleConnFuzz feeds handleConn random byte streams of varying lengths
+// instead of a well-formed handshake, to make sure a peer that sends garbage
+// can never make it panic or hang the goroutine serving it.
+func TestHandleConnFuzz(t *testing.T) {
+	passphrase := []byte("secret")
+	src := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		buf := make([]byte, src.Intn(512))
+		src.Read(buf)
+
+		conn := &rwc{}
+		conn.Write(buf)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			handleConn(conn, 3000, passphrase, nil)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("handleConn blocked indefinitely on %d random bytes", len(buf))
+		}
+	}
+}
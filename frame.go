@@ -0,0 +1,94 @@
+package wherez
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// frameType discriminates the messages exchanged over the encrypted tunnel
+// after the handshake. New types can be added without breaking older
+// clients: an unknown Type can always be skipped using Length, since Magic
+// and Version are still checked up front.
+type frameType uint8
+
+const (
+	frameTypeResponse frameType = iota + 1
+	// frameTypeSelfConnect is sent instead of frameTypeResponse when the
+	// server detects that the client dialed itself. It carries no payload;
+	// the client should stop trying that address.
+	frameTypeSelfConnect
+	// frameTypeProtoList carries one side's registered subprotocol names
+	// (see negotiateProtocols in session.go), exchanged once at the start of
+	// every Session.
+	frameTypeProtoList
+)
+
+// frame is the self-describing wire envelope for every message sent after
+// the handshake. It mirrors the shape of hello: a magic header and version
+// for cheap rejection of anything that isn't a current wherez peer.
+type frame struct {
+	Magic   [6]byte
+	Version uint8
+	Type    frameType
+	Length  uint32
+}
+
+// writeFrame sends typ with payload as its body.
+func writeFrame(w io.Writer, typ frameType, payload []byte) error {
+	var hdr frame
+	copy(hdr.Magic[:], magicHeader)
+	hdr.Version = ProtocolVersion
+	hdr.Type = typ
+	hdr.Length = uint32(len(payload))
+	if err := binary.Write(w, binary.LittleEndian, hdr); err != nil {
+		return err
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// readFrame reads a single message written by writeFrame. binary.Read
+// already uses io.ReadFull under the hood, so a short header never gets
+// misread as a complete one.
+func readFrame(r io.Reader) (frameType, []byte, error) {
+	var hdr frame
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return 0, nil, err
+	}
+	if !bytes.Equal(hdr.Magic[:], magicHeader) {
+		return 0, nil, errors.New("wherez: not a wherez frame")
+	}
+	if hdr.Version != ProtocolVersion {
+		return 0, nil, errVersionMismatch
+	}
+	if hdr.Length > maxFrameLen {
+		return 0, nil, fmt.Errorf("wherez: frame too large (%d bytes)", hdr.Length)
+	}
+	payload := make([]byte, hdr.Length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return hdr.Type, payload, nil
+}
+
+func encodeResponse(resp Response) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, resp)
+	return buf.Bytes()
+}
+
+func decodeResponse(payload []byte) (Response, error) {
+	var resp Response
+	err := binary.Read(bytes.NewReader(payload), binary.LittleEndian, &resp)
+	return resp, err
+}
+
+// errSelfConnect is returned by verifyPeer when the remote end reports that
+// we connected to ourselves.
+var errSelfConnect = errors.New("wherez: connected to ourselves")
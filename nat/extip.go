@@ -0,0 +1,20 @@
+package nat
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// ExtIP implements Interface for a statically configured external address,
+// for operators who already know their public IP (e.g. it's set on the
+// router out-of-band, or wherez runs on the NAT device itself).
+type ExtIP net.IP
+
+func (n ExtIP) ExternalIP() (net.IP, error) { return net.IP(n), nil }
+func (n ExtIP) String() string              { return fmt.Sprintf("extip:%v", net.IP(n)) }
+
+// AddMapping and DeleteMapping are no-ops: we assume the port is already
+// reachable on the given address.
+func (n ExtIP) AddMapping(string, int, int, string, time.Duration) error { return nil }
+func (n ExtIP) DeleteMapping(string, int, int) error                    { return nil }
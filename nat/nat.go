@@ -0,0 +1,106 @@
+// Package nat implements NAT traversal for the TCP port that wherez listens
+// on, so that peers can authenticate each other across the public Internet
+// without manual router configuration.
+package nat
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// An Interface knows how to discover its external IP address and how to map
+// an external port to a local one on the NAT device it represents.
+type Interface interface {
+	// ExternalIP returns the IP address of the NAT device as seen from the
+	// public Internet.
+	ExternalIP() (net.IP, error)
+
+	// AddMapping maps an external port to a local port for the given
+	// protocol ("tcp" or "udp"). name is a human readable description shown
+	// by some router UIs. lifetime is the requested duration of the mapping;
+	// implementations that don't support leases may ignore it.
+	AddMapping(protocol string, extport, intport int, name string, lifetime time.Duration) error
+
+	// DeleteMapping removes a previously added port mapping.
+	DeleteMapping(protocol string, extport, intport int) error
+
+	String() string
+}
+
+// mapTimeout is how often Map refreshes a mapping; each request asks for a
+// lease of twice that, so a mapping outlives one missed refresh. Routers are
+// free to expire mappings sooner, but this is a reasonable middle ground
+// between chattiness and leases expiring while wherez is still running.
+const mapTimeout = 20 * time.Minute
+
+// Parse parses a NAT interface description by the mechanism's name.
+// The following formats are currently accepted:
+//
+//	""                  no NAT traversal
+//	"none"              no NAT traversal
+//	"extip:77.12.33.4"  assume the given IP is already externally reachable
+//	"upnp"              port mapping with UPnP (tries IGDv2, then IGDv1)
+//	"natpmp"            port mapping with NAT-PMP
+func Parse(spec string) (Interface, error) {
+	var (
+		parts = strings.SplitN(spec, ":", 2)
+		mech  = strings.ToLower(parts[0])
+	)
+	switch mech {
+	case "", "none", "off":
+		return nil, nil
+	case "extip":
+		if len(parts) != 2 {
+			return nil, errors.New("missing IP address in extip spec")
+		}
+		ip := net.ParseIP(parts[1])
+		if ip == nil {
+			return nil, errors.New("invalid IP address in extip spec")
+		}
+		return ExtIP(ip), nil
+	case "upnp":
+		return UPnP(), nil
+	case "natpmp", "pmp":
+		var gateway net.IP
+		if len(parts) == 2 {
+			gateway = net.ParseIP(parts[1])
+			if gateway == nil {
+				return nil, errors.New("invalid IP address in natpmp spec")
+			}
+		}
+		return NATPMP(gateway), nil
+	default:
+		return nil, errors.New("unknown NAT mechanism " + mech)
+	}
+}
+
+// Map adds a port mapping on m and keeps it refreshed until stop is closed,
+// at which point the mapping is deleted. It is meant to be run in its own
+// goroutine, e.g. `go nat.Map(n, stop, "tcp", port, port, "wherez")`.
+func Map(m Interface, stop <-chan struct{}, protocol string, extport, intport int, name string) {
+	if m == nil {
+		return
+	}
+	refresh := time.NewTimer(mapTimeout)
+	defer refresh.Stop()
+	if err := m.AddMapping(protocol, extport, intport, name, mapTimeout*2); err != nil {
+		log.Println("nat: couldn't add port mapping:", err)
+	}
+	for {
+		select {
+		case <-refresh.C:
+			if err := m.AddMapping(protocol, extport, intport, name, mapTimeout*2); err != nil {
+				log.Println("nat: couldn't renew port mapping:", err)
+			}
+			refresh.Reset(mapTimeout)
+		case <-stop:
+			if err := m.DeleteMapping(protocol, extport, intport); err != nil {
+				log.Println("nat: couldn't delete port mapping:", err)
+			}
+			return
+		}
+	}
+}
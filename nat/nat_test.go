@@ -0,0 +1,72 @@
+package nat
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		spec    string
+		wantNil bool
+		wantErr bool
+	}{
+		{spec: "", wantNil: true},
+		{spec: "none", wantNil: true},
+		{spec: "off", wantNil: true},
+		{spec: "extip:77.12.33.4"},
+		{spec: "extip:not-an-ip", wantErr: true},
+		{spec: "extip", wantErr: true},
+		{spec: "upnp"},
+		{spec: "natpmp"},
+		{spec: "natpmp:10.0.0.1"},
+		{spec: "natpmp:not-an-ip", wantErr: true},
+		{spec: "bogus", wantErr: true},
+	} {
+		m, err := Parse(tc.spec)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("Parse(%q): got nil error, want one", tc.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tc.spec, err)
+			continue
+		}
+		if tc.wantNil && m != nil {
+			t.Errorf("Parse(%q) = %v, want nil", tc.spec, m)
+		}
+		if !tc.wantNil && m == nil {
+			t.Errorf("Parse(%q) = nil, want a non-nil Interface", tc.spec)
+		}
+	}
+}
+
+func TestParseExtIP(t *testing.T) {
+	m, err := Parse("extip:77.12.33.4")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	ip, err := m.ExternalIP()
+	if err != nil {
+		t.Fatalf("ExternalIP: %v", err)
+	}
+	if want := net.ParseIP("77.12.33.4"); !ip.Equal(want) {
+		t.Errorf("ExternalIP() = %v, want %v", ip, want)
+	}
+}
+
+func TestParseNATPMPWithGateway(t *testing.T) {
+	m, err := Parse("natpmp:10.0.0.1")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	n, ok := m.(*natpmp)
+	if !ok {
+		t.Fatalf("Parse(%q) returned %T, want *natpmp", "natpmp:10.0.0.1", m)
+	}
+	if want := net.ParseIP("10.0.0.1"); !n.gw.Equal(want) {
+		t.Errorf("natpmp.gw = %v, want %v", n.gw, want)
+	}
+}
@@ -0,0 +1,129 @@
+package nat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// natpmp implements Interface using the NAT-PMP protocol, RFC 6886.
+type natpmp struct {
+	gw net.IP
+}
+
+// NATPMP returns a port mapper that speaks NAT-PMP to gw. If gw is nil, the
+// gateway is guessed from the first non-loopback IPv4 address (see
+// defaultGateway).
+func NATPMP(gw net.IP) Interface {
+	if gw == nil {
+		gw, _ = defaultGateway()
+	}
+	return &natpmp{gw: gw}
+}
+
+func (n *natpmp) String() string {
+	return fmt.Sprintf("natpmp(%v)", n.gw)
+}
+
+const (
+	natpmpOpExternalAddress = 0
+	natpmpOpMapTCP          = 2
+	natpmpOpMapUDP          = 1
+	natpmpResultOK          = 0
+)
+
+func (n *natpmp) ExternalIP() (net.IP, error) {
+	req := []byte{0, natpmpOpExternalAddress}
+	resp, err := n.rpc(req, 12)
+	if err != nil {
+		return nil, err
+	}
+	if result := binary.BigEndian.Uint16(resp[2:4]); result != natpmpResultOK {
+		return nil, fmt.Errorf("natpmp: server returned error code %d", result)
+	}
+	return net.IPv4(resp[8], resp[9], resp[10], resp[11]), nil
+}
+
+func (n *natpmp) AddMapping(protocol string, extport, intport int, name string, lifetime time.Duration) error {
+	op := byte(natpmpOpMapUDP)
+	if protocol == "tcp" {
+		op = natpmpOpMapTCP
+	}
+	req := make([]byte, 12)
+	req[1] = op
+	binary.BigEndian.PutUint16(req[4:6], uint16(intport))
+	binary.BigEndian.PutUint16(req[6:8], uint16(extport))
+	binary.BigEndian.PutUint32(req[8:12], uint32(lifetime/time.Second))
+	resp, err := n.rpc(req, 16)
+	if err != nil {
+		return err
+	}
+	if result := binary.BigEndian.Uint16(resp[2:4]); result != natpmpResultOK {
+		return fmt.Errorf("natpmp: mapping request returned error code %d", result)
+	}
+	return nil
+}
+
+func (n *natpmp) DeleteMapping(protocol string, extport, intport int) error {
+	// Per RFC 6886 section 3.4, destroying a single mapping means resending
+	// the request for that mapping's real internal port with the external
+	// port and lifetime zeroed; an internal port of zero instead means
+	// "destroy all mappings for this client/protocol", which is not what
+	// callers of DeleteMapping ask for.
+	return n.AddMapping(protocol, 0, intport, "", 0)
+}
+
+// rpc sends req to the gateway's NAT-PMP port and waits for a response of
+// respLen bytes, retrying with exponential backoff as recommended by the RFC.
+func (n *natpmp) rpc(req []byte, respLen int) ([]byte, error) {
+	if n.gw == nil {
+		return nil, errors.New("natpmp: could not determine default gateway")
+	}
+	conn, err := net.Dial("udp4", net.JoinHostPort(n.gw.String(), "5351"))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	resp := make([]byte, respLen)
+	timeout := 250 * time.Millisecond
+	for tries := 0; tries < 9; tries++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		n, err := conn.Read(resp)
+		if err == nil && n == respLen {
+			return resp, nil
+		}
+		timeout *= 2
+	}
+	return nil, errors.New("natpmp: gateway did not respond")
+}
+
+// defaultGateway returns the IP address of the default route, assumed to be
+// the NAT device. There's no portable way to ask the OS for this, so we
+// guess it's the ".1" address of our own non-loopback /24.
+func defaultGateway() (net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() {
+			continue
+		}
+		ip4 := ipnet.IP.To4()
+		if ip4 == nil {
+			continue
+		}
+		gw := make(net.IP, 4)
+		copy(gw, ip4)
+		gw[3] = 1
+		return gw, nil
+	}
+	return nil, errors.New("natpmp: no suitable network interface found")
+}
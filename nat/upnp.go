@@ -0,0 +1,285 @@
+package nat
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// upnp implements Interface by talking SOAP to an Internet Gateway Device
+// found via SSDP. It supports both the WANIPConnection (IGDv1/IGDv2) and
+// WANPPPConnection service types.
+type upnp struct {
+	service    string // SOAP service type, e.g. urn:schemas-upnp-org:service:WANIPConnection:1
+	controlURL string
+	localIP    net.IP
+}
+
+// UPnP returns a port mapper that discovers an IGD on the local network via
+// SSDP. Discovery happens lazily, on the first call that needs it.
+func UPnP() Interface {
+	return &upnp{}
+}
+
+func (n *upnp) String() string { return "UPnP" }
+
+func (n *upnp) ExternalIP() (net.IP, error) {
+	if err := n.discover(); err != nil {
+		return nil, err
+	}
+	doc, err := n.soapRequest("GetExternalIPAddress", nil)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(doc["NewExternalIPAddress"])
+	if ip == nil {
+		return nil, errors.New("upnp: gateway returned no external IP address")
+	}
+	return ip, nil
+}
+
+func (n *upnp) AddMapping(protocol string, extport, intport int, name string, lifetime time.Duration) error {
+	if err := n.discover(); err != nil {
+		return err
+	}
+	if n.localIP == nil {
+		ip, err := localAddrFor(n.controlURL)
+		if err != nil {
+			return err
+		}
+		n.localIP = ip
+	}
+	// Remove any stale mapping first; routers are picky about overwriting.
+	n.DeleteMapping(protocol, extport, intport)
+	_, err := n.soapRequest("AddPortMapping", map[string]string{
+		"NewRemoteHost":             "",
+		"NewExternalPort":           fmt.Sprintf("%d", extport),
+		"NewProtocol":               strings.ToUpper(protocol),
+		"NewInternalPort":           fmt.Sprintf("%d", intport),
+		"NewInternalClient":         n.localIP.String(),
+		"NewEnabled":                "1",
+		"NewPortMappingDescription": name,
+		"NewLeaseDuration":          fmt.Sprintf("%d", int(lifetime/time.Second)),
+	})
+	return err
+}
+
+func (n *upnp) DeleteMapping(protocol string, extport, intport int) error {
+	if err := n.discover(); err != nil {
+		return err
+	}
+	_, err := n.soapRequest("DeletePortMapping", map[string]string{
+		"NewRemoteHost":   "",
+		"NewExternalPort": fmt.Sprintf("%d", extport),
+		"NewProtocol":     strings.ToUpper(protocol),
+	})
+	return err
+}
+
+// searchTargets are tried in order, so IGDv2 devices are preferred over the
+// older IGDv1 WANIPConnection/WANPPPConnection services.
+var searchTargets = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+// discover runs SSDP discovery once and fills in n.service/n.controlURL.
+func (n *upnp) discover() error {
+	if n.controlURL != "" {
+		return nil
+	}
+	loc, err := ssdpSearch()
+	if err != nil {
+		return fmt.Errorf("upnp: SSDP discovery failed: %v", err)
+	}
+	service, controlURL, err := fetchServiceControlURL(loc)
+	if err != nil {
+		return fmt.Errorf("upnp: could not read device description: %v", err)
+	}
+	n.service = service
+	n.controlURL = controlURL
+	return nil
+}
+
+// ssdpSearch multicasts an M-SEARCH for an InternetGatewayDevice and returns
+// the LOCATION URL of the first device that answers.
+func ssdpSearch() (string, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	dst := &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+	req := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: 239.255.255.250:1900\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n" +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n\r\n"
+	if _, err := conn.WriteTo([]byte(req), dst); err != nil {
+		return "", err
+	}
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return "", errors.New("no UPnP gateway responded")
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\r\n") {
+			if loc := strings.SplitN(line, ":", 2); len(loc) == 2 && strings.EqualFold(strings.TrimSpace(loc[0]), "LOCATION") {
+				return strings.TrimSpace(loc[1]), nil
+			}
+		}
+	}
+}
+
+// Minimal subset of the UPnP device description XML schema that we need.
+type xmlDevice struct {
+	Device struct {
+		DeviceList []struct {
+			ServiceList []struct {
+				ServiceType string `xml:"serviceType"`
+				ControlURL  string `xml:"controlURL"`
+			} `xml:"serviceList>service"`
+			DeviceList []struct {
+				ServiceList []struct {
+					ServiceType string `xml:"serviceType"`
+					ControlURL  string `xml:"controlURL"`
+				} `xml:"serviceList>service"`
+			} `xml:"deviceList>device"`
+		} `xml:"deviceList>device"`
+	} `xml:"device"`
+}
+
+// fetchServiceControlURL fetches the device description at loc and returns
+// the service type and control URL of the WAN connection service that comes
+// first in searchTargets.
+func fetchServiceControlURL(loc string) (service, controlURL string, err error) {
+	resp, err := http.Get(loc)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	var doc xmlDevice
+	if err := xml.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return "", "", err
+	}
+	for _, want := range searchTargets {
+		for _, d := range doc.Device.DeviceList {
+			for _, s := range d.ServiceList {
+				if u := matchService(s.ServiceType, s.ControlURL, want); u != "" {
+					return s.ServiceType, resolveURL(loc, u), nil
+				}
+			}
+			for _, d2 := range d.DeviceList {
+				for _, s := range d2.ServiceList {
+					if u := matchService(s.ServiceType, s.ControlURL, want); u != "" {
+						return s.ServiceType, resolveURL(loc, u), nil
+					}
+				}
+			}
+		}
+	}
+	return "", "", errors.New("no WAN connection service found")
+}
+
+func matchService(serviceType, controlURL, want string) string {
+	if serviceType == want {
+		return controlURL
+	}
+	return ""
+}
+
+func resolveURL(base, ref string) string {
+	if strings.HasPrefix(ref, "http://") || strings.HasPrefix(ref, "https://") {
+		return ref
+	}
+	i := strings.Index(base[len("http://"):], "/")
+	if i < 0 {
+		return base + ref
+	}
+	host := base[:len("http://")+i]
+	if !strings.HasPrefix(ref, "/") {
+		ref = "/" + ref
+	}
+	return host + ref
+}
+
+// soapRequest sends a SOAP action to the gateway's control URL and returns
+// the decoded response parameters.
+func (n *upnp) soapRequest(action string, args map[string]string) (map[string]string, error) {
+	var body bytes.Buffer
+	fmt.Fprintf(&body, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body><u:%s xmlns:u="%s">`, action, n.service)
+	for k, v := range args {
+		fmt.Fprintf(&body, "<%s>%s</%s>", k, v, k)
+	}
+	fmt.Fprintf(&body, `</u:%s></s:Body></s:Envelope>`, action)
+
+	req, err := http.NewRequest("POST", n.controlURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, n.service, action))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upnp: %s returned %s", action, resp.Status)
+	}
+
+	return decodeSOAPArgs(resp)
+}
+
+// decodeSOAPArgs does a loose decode of a SOAP response body into a flat
+// map of element name to text content, which is all the action responses
+// used here need.
+func decodeSOAPArgs(resp *http.Response) (map[string]string, error) {
+	dec := xml.NewDecoder(resp.Body)
+	out := map[string]string{}
+	var cur string
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			cur = t.Name.Local
+		case xml.CharData:
+			if cur != "" && strings.TrimSpace(string(t)) != "" {
+				out[cur] = string(t)
+			}
+		}
+	}
+	return out, nil
+}
+
+// localAddrFor dials the gateway's control URL host to find out which local
+// address the kernel would use to reach it, which is what NewInternalClient
+// needs to be set to.
+func localAddrFor(controlURL string) (net.IP, error) {
+	host := strings.TrimPrefix(controlURL, "http://")
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[:i]
+	}
+	conn, err := net.Dial("udp4", host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
@@ -0,0 +1,291 @@
+package wherez
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// PeerRecord is what PeerDB remembers about a single peer across restarts.
+type PeerRecord struct {
+	// Addr is the peer's wherez TCP address (host:port), used to reconnect
+	// directly without going through the DHT.
+	Addr string
+
+	// AppPort is the application port the peer last reported in a Response.
+	AppPort uint16
+
+	LastSeen  time.Time
+	Successes int
+	Failures  int
+}
+
+// peerStore persists a PeerDB's records. The default implementation is a
+// JSON file, but the interface leaves room for a real embedded KV store
+// later without disturbing PeerDB's callers.
+type peerStore interface {
+	load() (map[string]PeerRecord, error)
+	save(map[string]PeerRecord) error
+}
+
+// PeerDB remembers peers that have successfully completed verifyPeer, so
+// that a restarted node can reconnect to them directly instead of waiting
+// out a DHT bootstrap.
+type PeerDB struct {
+	mu      sync.Mutex
+	records map[string]PeerRecord
+	store   peerStore
+	ttl     time.Duration
+	stop    chan struct{}
+}
+
+// defaultPruneInterval is how often PeerDB checks for peers that haven't
+// been seen within the configured TTL.
+const defaultPruneInterval = 10 * time.Minute
+
+// NewPeerDB opens (or creates) the peer database at path and starts a
+// background pruner that forgets peers unseen for longer than ttl. A ttl of
+// zero disables pruning.
+func NewPeerDB(path string, ttl time.Duration) (*PeerDB, error) {
+	store := jsonFileStore{path: path}
+	records, err := store.load()
+	if err != nil {
+		return nil, err
+	}
+	db := &PeerDB{
+		records: records,
+		store:   store,
+		ttl:     ttl,
+		stop:    make(chan struct{}),
+	}
+	if ttl > 0 {
+		go db.prunePeriodically(defaultPruneInterval)
+	}
+	return db, nil
+}
+
+// Known returns the peers we've successfully verified before, most recently
+// seen first.
+func (db *PeerDB) Known() []Peer {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.sortedLocked(len(db.records))
+}
+
+// Forget removes addr from the database.
+func (db *PeerDB) Forget(addr string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.records[addr]; !ok {
+		return
+	}
+	delete(db.records, addr)
+	db.saveLocked()
+}
+
+// Close stops the background pruner. The database itself has no open
+// handles beyond the occasional file write, so Close is optional.
+func (db *PeerDB) Close() {
+	close(db.stop)
+}
+
+// recordSuccess marks addr as verified just now, reporting appPort.
+func (db *PeerDB) recordSuccess(addr string, appPort uint16) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	rec := db.records[addr]
+	rec.Addr = addr
+	rec.AppPort = appPort
+	rec.LastSeen = time.Now()
+	rec.Successes++
+	db.records[addr] = rec
+	db.saveLocked()
+}
+
+// recordFailure notes that addr didn't respond or failed authentication.
+func (db *PeerDB) recordFailure(addr string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	rec, ok := db.records[addr]
+	if !ok {
+		return
+	}
+	rec.Failures++
+	db.records[addr] = rec
+	db.saveLocked()
+}
+
+// topAddrs returns the dial addresses of the n most-recently-seen peers.
+func (db *PeerDB) topAddrs(n int) []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	addrs := make([]string, 0, len(db.records))
+	for addr := range db.records {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return db.records[addrs[i]].LastSeen.After(db.records[addrs[j]].LastSeen)
+	})
+	if len(addrs) > n {
+		addrs = addrs[:n]
+	}
+	return addrs
+}
+
+// sortedLocked returns up to n known peers ordered most-recently-seen first.
+// Callers must hold db.mu.
+func (db *PeerDB) sortedLocked(n int) []Peer {
+	records := make([]PeerRecord, 0, len(db.records))
+	for _, rec := range db.records {
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].LastSeen.After(records[j].LastSeen)
+	})
+	if len(records) > n {
+		records = records[:n]
+	}
+	peers := make([]Peer, 0, len(records))
+	for _, rec := range records {
+		host, _, err := net.SplitHostPort(rec.Addr)
+		if err != nil {
+			continue
+		}
+		peers = append(peers, Peer{Addr: net.JoinHostPort(host, fmt.Sprint(rec.AppPort))})
+	}
+	return peers
+}
+
+func (db *PeerDB) saveLocked() {
+	if err := db.store.save(db.records); err != nil {
+		log.Println("PeerDB: could not save peer database:", err)
+	}
+}
+
+func (db *PeerDB) prunePeriodically(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			db.prune()
+		case <-db.stop:
+			return
+		}
+	}
+}
+
+// prune evicts every peer not seen within the configured TTL.
+func (db *PeerDB) prune() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	cutoff := time.Now().Add(-db.ttl)
+	changed := false
+	for addr, rec := range db.records {
+		if rec.LastSeen.Before(cutoff) {
+			delete(db.records, addr)
+			changed = true
+		}
+	}
+	if changed {
+		db.saveLocked()
+	}
+}
+
+// topCandidateFactor controls how many more candidates than minPeers
+// reverifyKnownPeers tries, so that a few stale entries don't stop us from
+// reaching minPeers.
+const topCandidateFactor = 3
+
+// reverifyConcurrency bounds how many candidates reverifyKnownPeers dials at
+// once, so a handful of stale, slow-to-time-out peers can't serialize the
+// whole cold start.
+const reverifyConcurrency = 8
+
+// reverifyKnownPeers tries to directly re-authenticate the most-recently-seen
+// peers in db, skipping the DHT round-trip entirely, and reports how many
+// passed verification. This is what gives wherez a sub-second cold start when it
+// already knows about a live peer: candidates are dialed concurrently, since
+// after a restart the least-stale entries are often the ones that moved or
+// went away.
+func reverifyKnownPeers(db *PeerDB, passphrase []byte, minPeers int, c chan Peer) int {
+	addrs := db.topAddrs(minPeers * topCandidateFactor)
+
+	type outcome struct {
+		addr string
+		peer Peer
+		err  error
+	}
+	outcomes := make(chan outcome, len(addrs))
+	sem := make(chan struct{}, reverifyConcurrency)
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			peer, err := verifyPeer(addr, passphrase)
+			outcomes <- outcome{addr: addr, peer: peer, err: err}
+		}(addr)
+	}
+	go func() {
+		wg.Wait()
+		close(outcomes)
+	}()
+
+	found := 0
+	for o := range outcomes {
+		if o.err != nil {
+			db.recordFailure(o.addr)
+			continue
+		}
+		if _, portStr, err := net.SplitHostPort(o.peer.Addr); err == nil {
+			if port, err := strconv.Atoi(portStr); err == nil {
+				db.recordSuccess(o.addr, uint16(port))
+			}
+		}
+		c <- o.peer
+		found++
+	}
+	return found
+}
+
+// jsonFileStore is the default peerStore: the whole database as one JSON
+// object, rewritten on every change. Fine for the hundreds of peers wherez
+// is expected to track.
+type jsonFileStore struct {
+	path string
+}
+
+func (s jsonFileStore) load() (map[string]PeerRecord, error) {
+	records := map[string]PeerRecord{}
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return records, nil
+	}
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (s jsonFileStore) save(records map[string]PeerRecord) error {
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.path, data, 0600)
+}
@@ -0,0 +1,57 @@
+package wherez
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPeerDBRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "peers.json")
+
+	db, err := NewPeerDB(path, 0)
+	if err != nil {
+		t.Fatalf("NewPeerDB: %v", err)
+	}
+	db.recordSuccess("10.0.0.1:40000", 31337)
+	db.recordSuccess("10.0.0.2:40000", 31338)
+
+	reopened, err := NewPeerDB(path, 0)
+	if err != nil {
+		t.Fatalf("NewPeerDB (reopen): %v", err)
+	}
+	known := reopened.Known()
+	if len(known) != 2 {
+		t.Fatalf("want 2 known peers after reopening, got %d: %v", len(known), known)
+	}
+}
+
+func TestPeerDBForget(t *testing.T) {
+	db, err := NewPeerDB(filepath.Join(t.TempDir(), "peers.json"), 0)
+	if err != nil {
+		t.Fatalf("NewPeerDB: %v", err)
+	}
+	db.recordSuccess("10.0.0.1:40000", 31337)
+	db.Forget("10.0.0.1:40000")
+	if known := db.Known(); len(known) != 0 {
+		t.Fatalf("want no known peers after Forget, got %v", known)
+	}
+}
+
+func TestPeerDBPrune(t *testing.T) {
+	db, err := NewPeerDB(filepath.Join(t.TempDir(), "peers.json"), time.Minute)
+	if err != nil {
+		t.Fatalf("NewPeerDB: %v", err)
+	}
+	db.recordSuccess("10.0.0.1:40000", 31337)
+	db.records["10.0.0.1:40000"] = PeerRecord{
+		Addr:     "10.0.0.1:40000",
+		AppPort:  31337,
+		LastSeen: time.Now().Add(-2 * time.Hour),
+	}
+	db.prune()
+	if known := db.Known(); len(known) != 0 {
+		t.Fatalf("want stale peer pruned, got %v", known)
+	}
+}
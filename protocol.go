@@ -0,0 +1,85 @@
+package wherez
+
+import (
+	"errors"
+	"sync"
+)
+
+// MsgReadWriter lets a Protocol's Run function exchange length-prefixed
+// messages over its own subprotocol channel of a Session, without knowing
+// anything about the other protocols sharing the same connection.
+type MsgReadWriter interface {
+	WriteMsg(msg []byte) error
+	ReadMsg() ([]byte, error)
+}
+
+// Protocol is a subprotocol that can be multiplexed over an authenticated
+// wherez connection. Run is invoked once per Session and should block for as
+// long as the subprotocol has work to do; when any registered Protocol's Run
+// returns, the whole Session is torn down.
+type Protocol struct {
+	Name    string
+	Version uint16
+	Run     func(peer *Peer, rw MsgReadWriter) error
+}
+
+// Node manages authenticated wherez connections and multiplexes registered
+// Protocols over them, turning wherez from a discovery-only library into a
+// reusable authenticated overlay for application traffic.
+type Node struct {
+	mu        sync.Mutex
+	protocols map[string]Protocol
+}
+
+// NewNode returns a Node with no protocols registered.
+func NewNode() *Node {
+	return &Node{protocols: map[string]Protocol{}}
+}
+
+// Register adds p to the set of subprotocols run over every Session this
+// Node handles from now on. It's not safe to call concurrently with Dial or
+// Serve.
+//
+// Wire IDs are not assigned here: two independently-written applications
+// have no reason to call Register in the same order, so a Session instead
+// negotiates IDs by Name with its peer once it starts (see
+// negotiateProtocols in session.go).
+func (n *Node) Register(p Protocol) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.protocols[p.Name] = p
+}
+
+// Dial connects to addr, authenticates with passphrase, and runs every
+// registered Protocol against the resulting connection. It blocks until the
+// session ends. This replaces the "verify then reconnect" pattern: the same
+// authenticated connection used to check the peer is the one the protocols
+// run over.
+func (n *Node) Dial(addr string, passphrase []byte) error {
+	peer, err := verifyPeer(addr, passphrase)
+	if err != nil {
+		return err
+	}
+	return n.Serve(peer)
+}
+
+// Serve runs every registered Protocol against peer's already-authenticated
+// connection, as obtained from FindAuthenticatedPeers's channel. It blocks
+// until the session ends.
+func (n *Node) Serve(peer Peer) error {
+	if peer.Conn == nil {
+		return errors.New("wherez: peer has no usable connection to serve protocols over")
+	}
+	return newSession(peer.Conn, n, &peer).Run()
+}
+
+// protocolSnapshot returns a copy of the registered protocols, keyed by Name.
+func (n *Node) protocolSnapshot() map[string]Protocol {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ps := make(map[string]Protocol, len(n.protocols))
+	for name, p := range n.protocols {
+		ps[name] = p
+	}
+	return ps
+}
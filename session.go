@@ -0,0 +1,261 @@
+package wherez
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// muxHeaderLen is the size of the {protocolID, length} header prefixed to
+// every multiplexed message: a uint16 protocol ID and a uint32 payload
+// length.
+const muxHeaderLen = 6
+
+// Session multiplexes a Node's registered Protocols over a single
+// authenticated wherez connection, framing each subprotocol message as
+// {uint16 protocolID, uint32 length, payload}.
+type Session struct {
+	conn io.ReadWriteCloser
+	node *Node
+	peer *Peer
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	inboxes map[uint16]chan []byte
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newSession(conn io.ReadWriteCloser, node *Node, peer *Peer) *Session {
+	return &Session{
+		conn:    conn,
+		node:    node,
+		peer:    peer,
+		inboxes: map[uint16]chan []byte{},
+		done:    make(chan struct{}),
+	}
+}
+
+// Run negotiates a shared wire-ID mapping with the peer (see
+// negotiateProtocols), starts the Run function of every resulting Protocol
+// with its own read channel fed by the demultiplexer, and blocks until the
+// first one returns or the connection is lost. Whichever happens first tears
+// down the Session: the connection is closed and every protocol's ReadMsg
+// unblocks with io.EOF.
+func (s *Session) Run() error {
+	protocols, err := negotiateProtocols(s.conn, s.node.protocolSnapshot())
+	if err != nil {
+		return err
+	}
+
+	protoDone := make(chan error, len(protocols))
+	for id, p := range protocols {
+		ch := make(chan []byte, 16)
+		s.mu.Lock()
+		s.inboxes[id] = ch
+		s.mu.Unlock()
+		rw := &protoReadWriter{session: s, id: id, in: ch}
+		go func(p Protocol, rw *protoReadWriter) {
+			protoDone <- p.Run(s.peer, rw)
+		}(p, rw)
+	}
+
+	demuxDone := make(chan error, 1)
+	go func() { demuxDone <- s.demux() }()
+
+	select {
+	case err := <-protoDone:
+		s.Close()
+		<-demuxDone
+		return err
+	case err := <-demuxDone:
+		return err
+	}
+}
+
+// demux reads multiplexed frames off the connection and delivers each one to
+// the inbox of the protocol it's addressed to, until the connection errors
+// out or is closed.
+func (s *Session) demux() error {
+	for {
+		id, payload, err := readMuxFrame(s.conn)
+		if err != nil {
+			s.Close()
+			s.closeInboxes()
+			return err
+		}
+		s.mu.Lock()
+		ch, ok := s.inboxes[id]
+		s.mu.Unlock()
+		if !ok {
+			// Message for a protocol this side doesn't have registered.
+			continue
+		}
+		// Block rather than silently drop: a protocol's consumer falling
+		// behind applies backpressure to the whole connection (the same way
+		// a slow TCP reader would) instead of losing messages with no
+		// signal to ReadMsg's caller. Also watch s.done so a Session torn
+		// down by some other protocol's Run returning doesn't leave demux
+		// stuck writing to a channel nobody will ever read again.
+		select {
+		case ch <- payload:
+		case <-s.done:
+			s.closeInboxes()
+			return nil
+		}
+	}
+}
+
+func (s *Session) closeInboxes() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ch := range s.inboxes {
+		close(ch)
+	}
+}
+
+// Close tears down the Session's underlying connection.
+func (s *Session) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	return s.conn.Close()
+}
+
+// protoDescriptor is what negotiateProtocols exchanges about each registered
+// Protocol: enough to agree on a shared set by Name. Version is sent for
+// future use (e.g. preferring the higher of two mutually supported
+// versions); today's negotiation matches on Name alone.
+type protoDescriptor struct {
+	Name    string
+	Version uint16
+}
+
+// negotiateProtocols exchanges each side's registered protocol names with
+// the peer and returns a wire-ID mapping for the subset both sides support.
+//
+// Wire IDs can't just be assigned in Node.Register order: two independently
+// written applications have no reason to call Register in the same order,
+// so doing that silently cross-wires subprotocol traffic whenever the
+// orders differ. Instead, both sides send their own protocol list, compute
+// the same intersection (their own registered set ∩ what the peer just
+// announced, which is identical on both ends), and sort it by Name. Since
+// the inputs to that computation are identical on both sides, so is the
+// result: no further negotiation round-trip is needed to agree on IDs.
+func negotiateProtocols(conn io.ReadWriteCloser, local map[string]Protocol) (map[uint16]Protocol, error) {
+	localDescs := make([]protoDescriptor, 0, len(local))
+	for _, p := range local {
+		localDescs = append(localDescs, protoDescriptor{Name: p.Name, Version: p.Version})
+	}
+	if err := writeFrame(conn, frameTypeProtoList, encodeProtoList(localDescs)); err != nil {
+		return nil, err
+	}
+	typ, payload, err := readFrame(conn)
+	if err != nil {
+		return nil, err
+	}
+	if typ != frameTypeProtoList {
+		return nil, fmt.Errorf("wherez: expected a protocol list frame, got type %d", typ)
+	}
+	remoteDescs, err := decodeProtoList(payload)
+	if err != nil {
+		return nil, err
+	}
+	remoteNames := make(map[string]bool, len(remoteDescs))
+	for _, d := range remoteDescs {
+		remoteNames[d.Name] = true
+	}
+
+	var shared []string
+	for name := range local {
+		if remoteNames[name] {
+			shared = append(shared, name)
+		}
+	}
+	sort.Strings(shared)
+
+	negotiated := make(map[uint16]Protocol, len(shared))
+	for i, name := range shared {
+		negotiated[uint16(i)] = local[name]
+	}
+	return negotiated, nil
+}
+
+func encodeProtoList(descs []protoDescriptor) []byte {
+	var buf bytes.Buffer
+	for _, d := range descs {
+		buf.WriteByte(byte(len(d.Name)))
+		buf.WriteString(d.Name)
+		var version [2]byte
+		binary.BigEndian.PutUint16(version[:], d.Version)
+		buf.Write(version[:])
+	}
+	return buf.Bytes()
+}
+
+func decodeProtoList(payload []byte) ([]protoDescriptor, error) {
+	var descs []protoDescriptor
+	for len(payload) > 0 {
+		n := int(payload[0])
+		payload = payload[1:]
+		if len(payload) < n+2 {
+			return nil, errors.New("wherez: truncated protocol list")
+		}
+		descs = append(descs, protoDescriptor{
+			Name:    string(payload[:n]),
+			Version: binary.BigEndian.Uint16(payload[n : n+2]),
+		})
+		payload = payload[n+2:]
+	}
+	return descs, nil
+}
+
+func (s *Session) writeFrame(id uint16, payload []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	buf := make([]byte, muxHeaderLen+len(payload))
+	binary.BigEndian.PutUint16(buf[0:2], id)
+	binary.BigEndian.PutUint32(buf[2:6], uint32(len(payload)))
+	copy(buf[muxHeaderLen:], payload)
+	_, err := s.conn.Write(buf)
+	return err
+}
+
+func readMuxFrame(r io.Reader) (id uint16, payload []byte, err error) {
+	var hdr [muxHeaderLen]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	id = binary.BigEndian.Uint16(hdr[0:2])
+	length := binary.BigEndian.Uint32(hdr[2:6])
+	if length > maxFrameLen {
+		return 0, nil, fmt.Errorf("wherez: mux frame too large (%d bytes)", length)
+	}
+	payload = make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	return id, payload, err
+}
+
+// protoReadWriter is the MsgReadWriter handed to a single Protocol's Run
+// function; it reads only the frames demuxed for its own protocol ID.
+type protoReadWriter struct {
+	session *Session
+	id      uint16
+	in      chan []byte
+}
+
+func (rw *protoReadWriter) WriteMsg(msg []byte) error {
+	return rw.session.writeFrame(rw.id, msg)
+}
+
+func (rw *protoReadWriter) ReadMsg() ([]byte, error) {
+	msg, ok := <-rw.in
+	if !ok {
+		return nil, io.EOF
+	}
+	return msg, nil
+}
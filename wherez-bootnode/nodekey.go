@@ -0,0 +1,37 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+)
+
+// nodeIDLen matches the 20-byte node ID size used by the Mainline DHT.
+const nodeIDLen = 20
+
+// loadOrCreateNodeID reads a hex-encoded node ID from path, generating and
+// saving a new random one if the file doesn't exist yet.
+//
+// See nodekeyEnvVar in wherez-bootnode.go for why this isn't a documented
+// CLI flag: the returned ID isn't wired into the DHT node and has no effect
+// on routing-table churn today.
+func loadOrCreateNodeID(path string) ([]byte, error) {
+	if data, err := os.ReadFile(path); err == nil {
+		id, err := hex.DecodeString(string(data))
+		if err != nil {
+			return nil, err
+		}
+		return id, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	id := make([]byte, nodeIDLen)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(id)), 0600); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
@@ -0,0 +1,62 @@
+// Command wherez-bootnode runs a wherez node in announce-only mode: it joins
+// the DHT and helps other wherez nodes using the same passphrase find each
+// other, but doesn't listen for or verify incoming application peers itself.
+//
+// Operators seeding a private wherez network should run one or more of
+// these, reachable from the nodes that will use them as a bootstrap
+// address, with the same passphrase as that network.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/nictuku/wherez"
+)
+
+var (
+	port      = flag.Int("port", 40000, "UDP port for the DHT to listen on")
+	bootstrap = flag.String("bootstrap", "", "comma separated host:port list of DHT bootstrap nodes; uses the public default if empty")
+)
+
+// nodekeyEnvVar, if set, loads or creates a stable node ID at the given
+// path and logs it. This intentionally isn't a flag: github.com/nictuku/dht
+// has no API for setting the DHT node's own ID, so the value isn't wired
+// into anything and doesn't reduce routing-table churn on restart yet. It
+// exists only for operators already tracking this limitation who want a
+// stable value to log and identify the bootnode by; promoting it to a
+// documented -nodekey flag is future work that depends on upstream support.
+const nodekeyEnvVar = "WHEREZ_BOOTNODE_NODEKEY"
+
+func main() {
+	flag.Parse()
+	if len(flag.Args()) != 1 {
+		log.Fatalln("Usage: wherez-bootnode [options] <passphrase>")
+	}
+	if path := os.Getenv(nodekeyEnvVar); path != "" {
+		id, err := loadOrCreateNodeID(path)
+		if err != nil {
+			log.Fatalf("Could not load %s %q: %v", nodekeyEnvVar, path, err)
+		}
+		log.Printf("Node ID: %x", id)
+	}
+	c := wherez.FindAuthenticatedPeers(wherez.Options{
+		Port:           *port,
+		AppPort:        -1, // announce-only: no auth listener, just DHT.
+		Passphrase:     []byte(flag.Arg(0)),
+		BootstrapNodes: splitBootstrap(*bootstrap),
+	})
+	for range c {
+		// A bootnode doesn't care about any particular peer, it only helps
+		// others find each other.
+	}
+}
+
+func splitBootstrap(spec string) []string {
+	if spec == "" {
+		return nil
+	}
+	return strings.Split(spec, ",")
+}
@@ -18,83 +18,141 @@ import (
 	"crypto/sha1"
 	"crypto/sha256"
 	"fmt"
+	"io"
 	"log"
 	"time"
 
 	"github.com/nictuku/dht"
+	"github.com/nictuku/wherez/nat"
 )
 
+// Options configures FindAuthenticatedPeers. The zero value listens on a
+// random port, announces nothing and does not attempt NAT traversal.
+type Options struct {
+	// Port is used for both the wherez TCP protocol and the DHT's UDP
+	// traffic. A value of 0 picks a random port.
+	Port int
+
+	// AppPort, if positive, is advertised to authenticated peers as the port
+	// our application listens on, and causes this node to announce itself
+	// to the DHT. If zero or negative, this node only looks for peers.
+	AppPort int
+
+	// MinPeers is how many peers wherez tries to find as fast as possible.
+	MinPeers int
+
+	// Passphrase authenticates peers and seeds the DHT infohash.
+	Passphrase []byte
+
+	// NAT maps the TCP side of Port on the local NAT device, if any, when
+	// AppPort is positive. If nil, no port mapping is attempted and Port
+	// must already be reachable from the public Internet.
+	NAT nat.Interface
+
+	// PeerDB, if set, is consulted on startup for peers to re-verify
+	// directly, and is updated as peers succeed or fail authentication.
+	PeerDB *PeerDB
+
+	// BootstrapNodes seeds the DHT routing table on startup. If empty, the
+	// single built-in bootstrap node is used instead.
+	BootstrapNodes []string
+
+	// Node, if set, serves its registered Protocols over every incoming
+	// connection that completes authentication, instead of closing the
+	// connection once verified.
+	Node *Node
+}
+
+// defaultBootstrapNode is used when Options.BootstrapNodes is empty. It's
+// one node known to be part of the public wherez/BitTorrent DHT swarm.
+const defaultBootstrapNode = "213.239.195.138:40000"
+
 // FindAuthenticatedPeers uses the BitTorrent DHT network to find sibling
 // Wherez nodes that are using the same passphrase. Wherez will listen on the
-// specified port for both TCP and UDP protocols. The port must be accessible
-// from the public Internet (UPnP is not supported yet).
+// specified port for both TCP and UDP protocols. If opts.NAT is set and
+// opts.AppPort is positive, the TCP side of that port is also mapped on the
+// NAT device; the DHT's UDP traffic is not mapped.
 //
-// Wherez will try aggressively to find at least minPeers as fast as possible.
+// Wherez will try aggressively to find at least opts.MinPeers as fast as
+// possible.
 //
 // The passphrase will be used to authenticate remote peers. This wherez node
 // will keep running indefinitely as a DHT node.
 //
-// If appPort is a positive number, wherez will advertise that our main application
-// is on port appPort of the current host. If it's negative, it doesn't
-// announce itself as a peer.
-func FindAuthenticatedPeers(port, appPort, minPeers int, passphrase []byte) chan Peer {
+// If opts.AppPort is a positive number, wherez will advertise that our main
+// application is on port opts.AppPort of the current host. If it's negative,
+// it doesn't announce itself as a peer.
+func FindAuthenticatedPeers(opts Options) chan Peer {
 	c := make(chan Peer)
-	go findAuthenticatedPeers(port, appPort, minPeers, passphrase, c)
+	go findAuthenticatedPeers(opts, c)
 	return c
 }
 
 type Peer struct {
 	Addr string
+
+	// Conn is the authenticated, encrypted tunnel negotiated with this peer
+	// during verification. Applications that want to reuse it instead of
+	// reconnecting should claim it promptly; it's nil if unavailable.
+	Conn io.ReadWriteCloser
 }
 
 func (p Peer) String() string {
 	return fmt.Sprintf("%v", p.Addr)
 }
 
-func findAuthenticatedPeers(port, appPort, minPeers int, passphrase []byte, c chan Peer) {
+func findAuthenticatedPeers(opts Options, c chan Peer) {
 	defer close(c)
-	ih, err := infoHash(passphrase)
+	ih, err := infoHash(opts.Passphrase)
 	if err != nil {
 		log.Println("Could not calculate infohash for the provided passphrase", err)
 		return
 	}
 	announce := false
-	if appPort > 0 {
+	if opts.AppPort > 0 {
 		announce = true
-		if _, err = listenAuth(port, appPort, passphrase); err != nil {
+		_, stopNAT, err := listenAuth(opts.Port, opts.AppPort, opts.Passphrase, opts.NAT, opts.Node)
+		if err != nil {
 			log.Println("Could not open listener:", err)
 			return
 		}
+		// findAuthenticatedPeers runs for the rest of the process's life, but
+		// closing stopNAT here still guarantees the port mapping is removed
+		// on any of the early returns below.
+		defer close(stopNAT)
 	}
 	// Connect to the DHT network.
-	d, err := dht.NewDHTNode(port, minPeers, announce)
+	d, err := dht.NewDHTNode(opts.Port, opts.MinPeers, announce)
 	if err != nil {
 		log.Println("Could not create the DHT node:", err)
 		return
 	}
-	d.AddNode("213.239.195.138:40000")
+	bootstrapNodes := opts.BootstrapNodes
+	if len(bootstrapNodes) == 0 {
+		bootstrapNodes = []string{defaultBootstrapNode}
+	}
+	for _, addr := range bootstrapNodes {
+		d.AddNode(addr)
+	}
 	go d.DoDHT()
 	// Sends authenticated peers to channel c.
-	go obtainPeers(d, passphrase, c)
-
-	for {
-		// Keeps requesting for the infohash. This is a no-op if the
-		// DHT is satisfied with the number of peers it has found.
-		d.PeersRequest(string(ih), true)
+	go obtainPeers(d, opts.Passphrase, c, opts.PeerDB)
 
-		time.Sleep(5 * time.Second)
+	// If we already know of live peers from a previous run, try them
+	// directly before falling back to the DHT round-trip.
+	found := 0
+	if opts.PeerDB != nil {
+		found = reverifyKnownPeers(opts.PeerDB, opts.Passphrase, opts.MinPeers, c)
 	}
-}
 
-func obtainPeers(d *dht.DHT, passphrase []byte, c chan Peer) {
-	for r := range d.PeersRequestResults {
-		for _, peers := range r {
-			for _, x := range peers {
-				// A DHT peer for our infohash was found. It
-				// needs to be authenticated.
-				checkPeer(dht.DecodePeerAddress(x), passphrase, c)
-			}
+	for {
+		if found < opts.MinPeers {
+			// Keeps requesting for the infohash. This is a no-op if the
+			// DHT is satisfied with the number of peers it has found.
+			d.PeersRequest(string(ih), true)
 		}
+
+		time.Sleep(5 * time.Second)
 	}
 }
 
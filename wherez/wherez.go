@@ -5,13 +5,22 @@ import (
 	"fmt"
 	"log"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/nictuku/wherez"
+	"github.com/nictuku/wherez/nat"
 )
 
 // port for the wherez protocol (UDP+TCP).
 const port = 40000
 
+var (
+	natSpec   = flag.String("nat", "", `port mapping mechanism: "upnp", "natpmp", "extip:<IP>" or "" for none`)
+	dbPath    = flag.String("peerdb", "", "path to a file remembering known peers across restarts; disabled if empty")
+	bootstrap = flag.String("bootstrap", "", "comma separated host:port list of DHT bootstrap nodes; uses the public default if empty")
+)
+
 func main() {
 	flag.Parse()
 	if len(flag.Args()) != 2 {
@@ -21,10 +30,37 @@ func main() {
 	if err != nil {
 		log.Fatalf("Invalid port parameter: %v", err)
 	}
+	natm, err := nat.Parse(*natSpec)
+	if err != nil {
+		log.Fatalf("Invalid -nat flag: %v", err)
+	}
+	var db *wherez.PeerDB
+	if *dbPath != "" {
+		if db, err = wherez.NewPeerDB(*dbPath, 24*time.Hour); err != nil {
+			log.Fatalf("Could not open -peerdb %q: %v", *dbPath, err)
+		}
+	}
 	passphrase := flag.Arg(1)
-	c := wherez.FindAuthenticatedPeers(port, appPort, 1, []byte(passphrase))
+	c := wherez.FindAuthenticatedPeers(wherez.Options{
+		Port:           port,
+		AppPort:        appPort,
+		MinPeers:       1,
+		Passphrase:     []byte(passphrase),
+		NAT:            natm,
+		PeerDB:         db,
+		BootstrapNodes: splitBootstrap(*bootstrap),
+	})
 	for p := range c {
 		// Peer found!
 		fmt.Println(p.String())
 	}
 }
+
+// splitBootstrap parses a comma separated -bootstrap flag into a node list,
+// returning nil (the library default) if spec is empty.
+func splitBootstrap(spec string) []string {
+	if spec == "" {
+		return nil
+	}
+	return strings.Split(spec, ",")
+}
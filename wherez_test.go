@@ -16,7 +16,12 @@ func TestInfoHash(t *testing.T) {
 }
 
 func DisabledTestFindPeers(t *testing.T) {
-	c := FindAuthenticatedPeers(60000, 31337, 1, []byte("wherezexample"))
+	c := FindAuthenticatedPeers(Options{
+		Port:       60000,
+		AppPort:    31337,
+		MinPeers:   1,
+		Passphrase: []byte("wherezexample"),
+	})
 	for p := range c {
 		t.Logf("Found %v", p.String())
 		return